@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// cacheEntry records everything needed to decide, without re-converting,
+// whether a source file's previous output is still up to date.
+type cacheEntry struct {
+	ModTime       int64  `json:"mtime"`
+	Size          int64  `json:"size"`
+	Hash          string `json:"sha256_64k"`
+	OutputPath    string `json:"outputPath"`
+	OutputModTime int64  `json:"outputMtime"`
+}
+
+// cacheFile is the in-memory form of the JSON sidecar, keyed by absolute
+// source path.
+type cacheFile map[string]cacheEntry
+
+func defaultCachePath() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userCacheDir, "xlsx2csv", "cache.json"), nil
+}
+
+// loadCacheFile reads the cache sidecar, returning an empty cacheFile if it
+// does not exist yet.
+func loadCacheFile(path string) (cacheFile, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cacheFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := cacheFile{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return cacheFile{}, nil // corrupt cache, start fresh rather than failing the run
+	}
+	return entries, nil
+}
+
+func (c cacheFile) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0664)
+}
+
+// hashFirst64KiB hashes up to the first 64KiB of path, which is enough to
+// detect content changes without reading large XLSX files in full.
+func hashFirst64KiB(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer nowarnCloseCloser(file)
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, file, 64*1024); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashFileFull hashes the whole file at path, for exact content-drift
+// comparisons (-failOnChange) where a 64KiB prefix isn't enough.
+func hashFileFull(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer nowarnCloseCloser(file)
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// buildCacheEntry computes a fresh cacheEntry for sourcePath/outputPath.
+func buildCacheEntry(sourcePath string, outputPath string) (cacheEntry, error) {
+	sourceStat, err := os.Stat(sourcePath)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	hash, err := hashFirst64KiB(sourcePath)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	entry := cacheEntry{
+		ModTime:    sourceStat.ModTime().UnixNano(),
+		Size:       sourceStat.Size(),
+		Hash:       hash,
+		OutputPath: outputPath,
+	}
+	if outputStat, err := os.Stat(outputPath); err == nil {
+		entry.OutputModTime = outputStat.ModTime().UnixNano()
+	}
+	return entry, nil
+}
+
+// cacheEntryIsFresh reports whether entry still matches sourcePath's current
+// mtime/size/content and outputPath still exists with its recorded mtime.
+func cacheEntryIsFresh(entry cacheEntry, sourcePath string, outputPath string) bool {
+	sourceStat, err := os.Stat(sourcePath)
+	if err != nil {
+		return false
+	}
+	if sourceStat.ModTime().UnixNano() != entry.ModTime || sourceStat.Size() != entry.Size {
+		return false
+	}
+	if entry.OutputPath != outputPath {
+		return false
+	}
+	outputStat, err := os.Stat(outputPath)
+	if err != nil {
+		return false
+	}
+	if outputStat.ModTime().UnixNano() != entry.OutputModTime {
+		return false
+	}
+	hash, err := hashFirst64KiB(sourcePath)
+	if err != nil || hash != entry.Hash {
+		return false
+	}
+	return true
+}
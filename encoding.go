@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// encodingRegistry maps our canonical, lowercased names to their x/text encodings.
+// This registry is tried first and covers the common aliases users actually
+// type; ianaindex.MIME is the fallback for any other name.
+var encodingRegistry = map[string]encoding.Encoding{
+	"utf-8":        unicode.UTF8,
+	"utf8":         unicode.UTF8,
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf-16":       unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"gbk":          simplifiedchinese.GBK,
+	"gb18030":      simplifiedchinese.GB18030,
+	"gb2312":       simplifiedchinese.GBK,
+	"shift_jis":    japanese.ShiftJIS,
+	"shift-jis":    japanese.ShiftJIS,
+	"sjis":         japanese.ShiftJIS,
+	"euc-jp":       japanese.EUCJP,
+	"euc-kr":       korean.EUCKR,
+	"windows-1251": charmap.Windows1251,
+	"windows-1252": charmap.Windows1252,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin1":       charmap.ISO8859_1,
+}
+
+// legacySingleByteEncodings cannot carry a byte-order/signature marker; a BOM
+// written ahead of them is just three/two garbage bytes to the reading app.
+var legacySingleByteEncodings = map[string]bool{
+	"windows-1251": true,
+	"windows-1252": true,
+	"iso-8859-1":   true,
+	"latin1":       true,
+}
+
+// resolveEncoding looks up name (case-insensitive) in encodingRegistry, falling
+// back to ianaindex.MIME for anything else IANA knows about.
+func resolveEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "utf-8" || name == "utf8" {
+		return nil, nil // nil encoding means "no transform, raw UTF-8"
+	}
+	if enc, ok := encodingRegistry[name]; ok {
+		return enc, nil
+	}
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unknown -encoding %q, see -listEncodings", name)
+	}
+	return enc, nil
+}
+
+// listEncodingNames returns the sorted set of canonical names accepted by -encoding.
+func listEncodingNames() []string {
+	names := make([]string, 0, len(encodingRegistry))
+	for name := range encodingRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bomFor returns the byte-order marker to emit for -bom with the given
+// encoding name, or nil if the encoding has none.
+func bomFor(name string) []byte {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "utf-8", "utf8":
+		return []byte{0xEF, 0xBB, 0xBF}
+	case "utf-16le", "utf-16":
+		return []byte{0xFF, 0xFE}
+	case "utf-16be":
+		return []byte{0xFE, 0xFF}
+	default:
+		return nil
+	}
+}
+
+// warnIfBomUnsupported writes a stderr warning when -bom is combined with one
+// of the legacy single-byte codepages in legacySingleByteEncodings, for which
+// no BOM is written. Other encodings without a BOM (e.g. gbk, shift_jis) also
+// get no BOM, but without a warning.
+func warnIfBomUnsupported(encodingName string) {
+	name := strings.ToLower(strings.TrimSpace(encodingName))
+	if legacySingleByteEncodings[name] {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("warning: -bom has no effect on -encoding=%s (no byte-order marker for single-byte encodings)\n", encodingName))
+	}
+}
+
+// isUTF8EncodingName reports whether name refers to plain UTF-8 (including
+// the default empty string), as opposed to a transcoding target.
+func isUTF8EncodingName(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name == "" || name == "utf-8" || name == "utf8"
+}
+
+// warnIfEncodingIgnoredForFormat writes a stderr warning when -encoding is
+// combined with an output format whose content is structural (JSON/NDJSON
+// punctuation, Parquet's own file encoding) rather than a flat byte stream:
+// transcoding only the cell values inside such a format would leave the
+// structural bytes in UTF-8, producing a file that is neither the requested
+// encoding nor valid UTF-8.
+func warnIfEncodingIgnoredForFormat(encodingName string, format string) {
+	if isUTF8EncodingName(encodingName) {
+		return
+	}
+	_, _ = os.Stderr.WriteString(fmt.Sprintf("warning: -encoding=%s is ignored for -format=%s (only csv/tsv output is transcoded; output stays UTF-8)\n", encodingName, format))
+}
@@ -4,16 +4,17 @@ package main
 // @todo: add i18n arg
 
 import (
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"github.com/technix86/golang-tablescanner"
+	"golang.org/x/text/transform"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
-	"sort"
+	"runtime/pprof"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,17 +34,36 @@ type TRunParameters struct {
 	FormatDateFixed         *string
 	AddBOMUTF8              *bool
 	AutoTrim                *bool
+	OutputEncoding          *string
+	ListEncodings           *bool
+	AllSheets               *bool
+	Recursive               *bool
+	IncludeGlobs            *string
+	ExcludeGlobs            *string
+	FollowSymlinks          *bool
+	Force                   *bool
+	NoCache                 *bool
+	FailOnChange            *bool
+	CPUProfile              *string
+	MemProfile              *string
+	Format                  *string
+	NoHeader                *bool
 }
 
 const dummyThousandSeparator = "depends on i18n"
 
+// sheetIndexFlag, sheetAllFlag back the -sheet flag: it is usually an int,
+// but also accepts the literal "all" to trigger AllSheets mode.
+var sheetIndexFlag, sheetAllFlag = newSheetIndexFlag("sheet", "Index of sheet to convert, zero based, -1=currently selected, \"all\"=every sheet (see -allSheets)")
+
 var runParameters = &TRunParameters{
 	XLSXPath:                flag.String("xlsx", "", "[single file mode] Path to input XLSX/XLS file"),
-	CSVPath:                 flag.String("csv", "", "[single file mode] Path to output CSV file (stdout of empty)"),
+	CSVPath:                 flag.String("csv", "", "[single file mode] Path to output CSV file (stdout if empty); with -allSheets, a template accepting #sheet#/#name# tokens"),
 	BatchPath:               flag.String("batch", "", "[batch mode] Folder path for convert (all .xlsx/.xls files are converted to CSV with same names by default)"),
-	BatchPathFilenameMask:   flag.String("batchMask", "*/*.csv", "[batch mode] Output batch path mask like '*/converted/raw-*-out.csv')"),
+	BatchPathFilenameMask:   flag.String("batchMask", "*/*.csv", "[batch mode] Output batch path mask like '*/converted/raw-*-out.csv', also accepts #sheet#/#name# tokens"),
 	BatchThreads:            flag.Int("batchThreads", 1, "[batch mode] how many asynchronous workers should run, 0 for auto=numcpu"),
-	SheetIndex:              flag.Int("sheet", -1, "Index of sheet to convert, zero based, -1=currently selected"),
+	SheetIndex:              sheetIndexFlag,
+	AllSheets:               flag.Bool("allSheets", false, "Convert every sheet, writing each to its own file (same as -sheet=all)"),
 	Delimiter:               flag.String("delimiter", ";", "CSV delimiter"),
 	FormatRaw:               flag.Bool("fmtRaw", false, "[XLSX only] Use real cell values instead of rendered with cell format"),
 	FormatI18n:              flag.String("fmtI18n", "en", "[XLSX only] Use specific I18n for builtin number formats"),
@@ -51,14 +71,59 @@ var runParameters = &TRunParameters{
 	FormatDecimalSeparator:  flag.String("fmtDecimal", "", "[XLSX only] Custom decimal separator for number formats"),
 	FormatThousandSeparator: flag.String("fmtThousand", dummyThousandSeparator, "[XLSX only] Custom thousand separator for number formats"),
 	FormatDateFixed:         flag.String("fmtDateFixed", "", "[XLSX only] Custom date format for any datetime cell"),
-	AddBOMUTF8:              flag.Bool("bom", false, "Start output stream/file/files with UTF-8 BOM = EF BB BF"),
+	AddBOMUTF8:              flag.Bool("bom", false, "Start output stream/file/files with a byte-order marker matching -encoding (UTF-8 default: EF BB BF)"),
 	AutoTrim:                flag.Bool("trim", false, "Trim whitespaces"),
+	OutputEncoding:          flag.String("encoding", "utf-8", "Output byte encoding of the generated CSV, see -listEncodings"),
+	ListEncodings:           flag.Bool("listEncodings", false, "Print the sorted list of supported -encoding names and exit"),
+	Recursive:               flag.Bool("recursive", false, "[batch mode] Descend into subfolders of -batch instead of just its top level"),
+	IncludeGlobs:            flag.String("include", "", "[batch mode] Comma-separated doublestar globs a file must match (relative to -batch), default *.xlsx/*.xls"),
+	ExcludeGlobs:            flag.String("exclude", "", "[batch mode] Comma-separated doublestar globs to skip (relative to -batch), e.g. '**/archive/**'"),
+	FollowSymlinks:          flag.Bool("followSymlinks", false, "[batch mode] Follow symlinked files/folders while walking -batch (cycle-safe)"),
+	Force:                   flag.Bool("force", false, "[batch mode] Ignore the cache and reconvert every matched file"),
+	NoCache:                 flag.Bool("noCache", false, "[batch mode] Disable the ~/.cache/xlsx2csv cache entirely"),
+	FailOnChange:            flag.Bool("failOnChange", false, "[batch mode] Exit non-zero if any output file would be (re)written, for CI drift checks"),
+	CPUProfile:              flag.String("cpuProfile", "", "Write a CPU profile to this path"),
+	MemProfile:              flag.String("memProfile", "", "Write a heap profile to this path"),
+	Format:                  flag.String("format", "csv", "Output format: csv, tsv, ndjson, json or parquet"),
+	NoHeader:                flag.Bool("noHeader", false, "[ndjson/json/parquet only] Treat the first row as data, naming columns col1, col2, ..."),
 }
 
 func main() {
 	flag.Parse()
+	if *runParameters.ListEncodings {
+		for _, name := range listEncodingNames() {
+			fmt.Println(name)
+		}
+		return
+	}
+	if *sheetAllFlag {
+		*runParameters.AllSheets = true
+	}
+	if *runParameters.AllSheets {
+		if len(*runParameters.XLSXPath) > 0 && "" == *runParameters.CSVPath {
+			_, _ = os.Stderr.WriteString("-allSheets/-sheet=all requires -csv to be set (it is used as a #sheet#/#name# template, stdout can't hold more than one sheet)\n")
+			os.Exit(1)
+		}
+		if len(*runParameters.BatchPath) > 0 && "" == *runParameters.BatchPathFilenameMask {
+			_, _ = os.Stderr.WriteString("-allSheets/-sheet=all requires -batchMask to be set (it is used as a #sheet#/#name# template)\n")
+			os.Exit(1)
+		}
+		if *runParameters.FailOnChange {
+			_, _ = os.Stderr.WriteString("-failOnChange cannot be combined with -allSheets/-sheet=all: per-sheet output paths aren't known before conversion, so there is no prior content to diff against\n")
+			os.Exit(1)
+		}
+	}
+	if "" != *runParameters.CPUProfile {
+		f, err := os.Create(*runParameters.CPUProfile)
+		if err != nil {
+			_, _ = os.Stderr.WriteString(fmt.Sprintf("cannot create -cpuProfile file: %s\n", err.Error()))
+			os.Exit(1)
+		}
+		_ = pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
 	if len(*runParameters.XLSXPath) > 0 {
-		err := xlsx2csv(runParameters)
+		_, err := xlsx2csv(runParameters)
 		if err != nil {
 			_, _ = os.Stderr.WriteString(fmt.Sprintf("main.XLSX2CSV() error: %s\n", err.Error()))
 		}
@@ -69,12 +134,27 @@ func main() {
 		err := batchXlsx2csv(runParameters)
 		if err != nil {
 			fmt.Println(err.Error())
-			return
+			writeMemProfile(runParameters)
+			os.Exit(1)
 		}
 	} else {
 		flag.PrintDefaults()
 		return
 	}
+	writeMemProfile(runParameters)
+}
+
+func writeMemProfile(runParameters *TRunParameters) {
+	if "" == *runParameters.MemProfile {
+		return
+	}
+	f, err := os.Create(*runParameters.MemProfile)
+	if err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("cannot create -memProfile file: %s\n", err.Error()))
+		return
+	}
+	defer nowarnCloseCloser(f)
+	_ = pprof.WriteHeapProfile(f)
 }
 
 func getRealCSVPath(destinationMask string, source string) string {
@@ -96,36 +176,28 @@ type fileSortInfo struct {
 }
 
 func batchXlsx2csv(runParameters *TRunParameters) error {
-	file, err := os.Open(*runParameters.BatchPath)
-	if err != nil {
-		return err
-	}
-	defer nowarnCloseCloser(file)
-	stat, err := file.Stat()
+	stats := newRunStats()
+	files, err := collectBatchFiles(runParameters, stats)
 	if err != nil {
 		return err
 	}
-	if !stat.IsDir() {
-		return fmt.Errorf("%s is not a directory", *runParameters.BatchPath)
-	}
-	dirContents, err := file.Readdir(0)
-	if err != nil {
-		return err
-	}
-	files := make([]fileSortInfo, 0) // file=>filesize
-	for _, fileInner := range dirContents {
-		if fileInner.IsDir() {
-			continue
+
+	batchMask := applyFormatExtension(*runParameters.BatchPathFilenameMask, *runParameters.Format)
+
+	var cachePath string
+	cache := cacheFile{}
+	var cacheMu sync.Mutex
+	if !*runParameters.NoCache {
+		cachePath, err = defaultCachePath()
+		if err != nil {
+			return err
 		}
-		fileSrc := file.Name() + string(os.PathSeparator) + fileInner.Name()
-		ext := filepath.Ext(fileSrc)
-		if strings.ToLower(ext) == ".xlsx" || strings.ToLower(ext) == ".xls" {
-			files = append(files, fileSortInfo{name: fileSrc, size: fileInner.Size()})
+		cache, err = loadCacheFile(cachePath)
+		if err != nil {
+			return err
 		}
 	}
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].size > files[j].size
-	})
+
 	tasks := make(chan string, len(files))
 	reports := make(chan int, len(files))
 	for workerId := 0; workerId < *runParameters.BatchThreads; workerId++ {
@@ -138,16 +210,66 @@ func batchXlsx2csv(runParameters *TRunParameters) error {
 				if !ok {
 					return
 				}
-				fileDstName := getRealCSVPath(*runParameters.BatchPathFilenameMask, fileSrcName)
+				fileDstName := getRealCSVPath(batchMask, fileSrcName)
+				cacheKey := fileSrcName
+				if abs, absErr := filepath.Abs(fileSrcName); absErr == nil {
+					cacheKey = abs
+				}
+
+				if !*runParameters.NoCache && !*runParameters.Force && !*runParameters.AllSheets {
+					cacheMu.Lock()
+					entry, cached := cache[cacheKey]
+					cacheMu.Unlock()
+					if cached && cacheEntryIsFresh(entry, fileSrcName, fileDstName) {
+						stats.addCached(1)
+						fmt.Printf("SKIP [%d] %s (cached)\n", workerId, fileSrcName)
+						reports <- 0
+						continue
+					}
+				}
+
+				var preHash string
+				var preHashErr error
+				if *runParameters.FailOnChange && !*runParameters.AllSheets {
+					preHash, preHashErr = hashFileFull(fileDstName)
+				}
+
 				runThreadParameters := *runParameters
 				runThreadParameters.XLSXPath = &fileSrcName
 				runThreadParameters.CSVPath = &fileDstName
 				fmt.Printf("START[%d] %s\n", workerId, fileSrcName)
-				err := xlsx2csv(&runThreadParameters)
+				producedFiles, err := xlsx2csv(&runThreadParameters)
 				if nil != err {
 					_, _ = os.Stderr.WriteString(fmt.Sprintf("  ERR[%d] %s: %s\n", workerId, fileSrcName, err.Error()))
+					stats.addFailed(1)
+				} else {
+					stats.addConverted(int64(len(producedFiles)))
+					if sourceStat, statErr := os.Stat(fileSrcName); statErr == nil {
+						stats.addBytesIn(sourceStat.Size())
+					}
+					if !*runParameters.NoCache && !*runParameters.AllSheets && len(producedFiles) == 1 {
+						if newEntry, buildErr := buildCacheEntry(fileSrcName, producedFiles[0]); buildErr == nil {
+							cacheMu.Lock()
+							cache[cacheKey] = newEntry
+							cacheMu.Unlock()
+						}
+					}
+					if *runParameters.FailOnChange && len(producedFiles) == 1 {
+						postHash, postHashErr := hashFileFull(producedFiles[0])
+						if preHashErr != nil || postHashErr != nil || preHash != postHash {
+							stats.addChanged(1)
+						}
+					}
+				}
+				if len(producedFiles) == 0 {
+					producedFiles = []string{fileDstName}
+				}
+				for _, producedFile := range producedFiles {
+					if outputStat, statErr := os.Stat(producedFile); statErr == nil {
+						stats.addBytesOut(outputStat.Size())
+					}
+					fmt.Printf("END  [%d] %s\n", workerId, producedFile)
 				}
-				fmt.Printf("END  [%d] %s\n", workerId, fileDstName)
 				reports <- 0
 			}
 		}(workerId)
@@ -160,15 +282,25 @@ func batchXlsx2csv(runParameters *TRunParameters) error {
 	}
 	close(tasks)
 	time.Sleep(time.Millisecond * 100)
+
+	if !*runParameters.NoCache {
+		if err := cache.save(cachePath); err != nil {
+			return err
+		}
+	}
+	fmt.Println(stats.String())
+	if *runParameters.FailOnChange && stats.anyChanged() {
+		return fmt.Errorf("changes detected: %d file(s) differ from their committed output", stats.changed)
+	}
 	return nil
 }
 
-func xlsx2csv(runParameters *TRunParameters) error {
+func xlsx2csv(runParameters *TRunParameters) ([]string, error) {
 	var scanner tablescanner.ITableDocumentScanner
 	err, xlsx := tablescanner.NewTableStream(*runParameters.XLSXPath)
 
 	if err != nil {
-		return fmt.Errorf("cannot parse file [%s]: %s\n", *runParameters.XLSXPath, err.Error())
+		return nil, fmt.Errorf("cannot parse file [%s]: %s\n", *runParameters.XLSXPath, err.Error())
 	}
 	_ = xlsx.SetI18n(*runParameters.FormatI18n) // just try if possible
 	xlsx.Formatter().SetDateFixedFormat(*runParameters.FormatDateFixed)
@@ -193,45 +325,116 @@ func xlsx2csv(runParameters *TRunParameters) error {
 	}
 	scanner = xlsx
 	defer nowarnCloseCloser(xlsx)
-	var outputFile = os.Stdout
-	var csvWriter *csv.Writer
-	if "" != *runParameters.CSVPath {
-		err = os.MkdirAll(filepath.Dir(*runParameters.CSVPath), 0775)
-		if nil != err {
-			return err
+
+	sheetIDs := []int{*runParameters.SheetIndex}
+	sheetNames := []string{""}
+	if *runParameters.AllSheets {
+		sheets := xlsx.GetSheets()
+		rawNames := make([]string, len(sheets))
+		sheetIDs = make([]int, len(sheets))
+		for sheetID, sheet := range sheets {
+			sheetIDs[sheetID] = sheetID
+			rawNames[sheetID] = sheet.GetName()
 		}
-		outputFile, err = os.Create(*runParameters.CSVPath)
-		if nil != err {
-			return fmt.Errorf("cannot create file [%s]: %s\n", *runParameters.CSVPath, err.Error())
+		sheetNames = dedupeSheetNames(sanitizeSheetNames(rawNames))
+	}
+
+	producedFiles := make([]string, 0, len(sheetIDs))
+	for i, sheetID := range sheetIDs {
+		if sheetID >= 0 {
+			if err := xlsx.SetSheetId(sheetID); nil != err {
+				return producedFiles, err
+			}
+		}
+		csvPath := *runParameters.CSVPath
+		if *runParameters.AllSheets {
+			csvPath = applySheetTokens(csvPath, sheetID, sheetNames[i])
 		}
+		if err := writeSheetCSV(runParameters, scanner, csvPath); nil != err {
+			return producedFiles, err
+		}
+		producedFiles = append(producedFiles, csvPath)
 	}
-	defer nowarnCloseCloser(outputFile)
-	csvWriter = csv.NewWriter(outputFile)
-	defer csvWriter.Flush()
-	csvWriter.Comma = []rune(*runParameters.Delimiter)[0]
-	if *runParameters.SheetIndex >= 0 {
-		err := xlsx.SetSheetId(*runParameters.SheetIndex)
+	return producedFiles, nil
+}
+
+// writeSheetCSV scans the currently-selected sheet and writes it to csvPath
+// (stdout if empty) through the RowSink selected by -format, applying the
+// delimiter/encoding/BOM settings (CSV/TSV only - parquet owns its own file).
+func writeSheetCSV(runParameters *TRunParameters, scanner tablescanner.ITableDocumentScanner, csvPath string) error {
+	format := strings.ToLower(*runParameters.Format)
+
+	var sink RowSink
+	var outputFile *os.File
+	if format == "parquet" {
+		warnIfEncodingIgnoredForFormat(*runParameters.OutputEncoding, format)
+		parquetSink, err := newParquetRowSink(csvPath, *runParameters.NoHeader)
 		if nil != err {
 			return err
 		}
-	}
-	iteration := 0
-	for nil == scanner.Scan() {
-		if *runParameters.AddBOMUTF8 && iteration == 0 {
-			_, err = outputFile.Write([]byte{0xEF, 0xBB, 0xBF})
+		sink = parquetSink
+	} else {
+		outputFile = os.Stdout
+		if "" != csvPath {
+			err := os.MkdirAll(filepath.Dir(csvPath), 0775)
+			if nil != err {
+				return err
+			}
+			outputFile, err = os.Create(csvPath)
+			if nil != err {
+				return fmt.Errorf("cannot create file [%s]: %s\n", csvPath, err.Error())
+			}
+		}
+		defer nowarnCloseCloser(outputFile)
+
+		// -encoding/-bom only make sense for a flat byte stream (csv/tsv);
+		// ndjson/json have their own structural bytes that must stay UTF-8,
+		// so transcoding just the cell values would produce neither valid
+		// UTF-8 nor valid JSON.
+		transcodable := format == "" || format == "csv" || format == "tsv"
+
+		var output io.Writer = outputFile
+		if transcodable {
+			outputEncoder, err := resolveEncoding(*runParameters.OutputEncoding)
 			if nil != err {
 				return err
 			}
+			if *runParameters.AddBOMUTF8 {
+				warnIfBomUnsupported(*runParameters.OutputEncoding)
+				if bom := bomFor(*runParameters.OutputEncoding); bom != nil {
+					if _, err := outputFile.Write(bom); nil != err {
+						return err
+					}
+				}
+			}
+			if nil != outputEncoder {
+				output = transform.NewWriter(outputFile, outputEncoder.NewEncoder())
+			}
+		} else {
+			warnIfEncodingIgnoredForFormat(*runParameters.OutputEncoding, format)
 		}
+
+		var err error
+		sink, err = newRowSink(format, output, csvPath, *runParameters.Delimiter, *runParameters.NoHeader)
+		if nil != err {
+			return err
+		}
+	}
+	defer nowarnCloseCloser(sink)
+
+	iteration := 0
+	for nil == scanner.Scan() {
 		data := scanner.GetScanned()
-		err := csvWriter.Write(data)
+		var err error
+		if iteration == 0 {
+			err = sink.WriteHeader(data)
+		} else {
+			err = sink.WriteRow(data)
+		}
 		if nil != err {
 			return err
 		}
 		iteration++
-		if iteration%10000 == 0 {
-			csvWriter.Flush()
-		}
 	}
 	returnError := scanner.GetLastScanError()
 	if returnError == io.EOF {
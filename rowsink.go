@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// RowSink is the per-row output destination xlsx2csv writes scanned rows to.
+// WriteHeader is called once with the first scanned row, before any WriteRow
+// calls (and not at all for an empty sheet); sinks that don't need a header
+// (csv/tsv) just treat it as an ordinary row.
+type RowSink interface {
+	WriteHeader(header []string) error
+	WriteRow(row []string) error
+	Close() error
+}
+
+const parquetSchemaSampleSize = 100
+
+// newRowSink builds the RowSink for -format, writing to output (or, for
+// -format=parquet, to outputPath on disk - parquet needs random-access
+// writes and can't stream through an io.Writer).
+func newRowSink(format string, output io.Writer, outputPath string, delimiter string, noHeader bool) (RowSink, error) {
+	switch strings.ToLower(format) {
+	case "", "csv":
+		return newDelimitedRowSink(output, []rune(delimiter)[0]), nil
+	case "tsv":
+		return newDelimitedRowSink(output, '\t'), nil
+	case "ndjson":
+		return newNdjsonRowSink(output, noHeader), nil
+	case "json":
+		return newJSONArrayRowSink(output, noHeader), nil
+	case "parquet":
+		return newParquetRowSink(outputPath, noHeader)
+	default:
+		return nil, fmt.Errorf("unknown -format %q (want csv, tsv, ndjson, json or parquet)", format)
+	}
+}
+
+// applyFormatExtension rewrites a literal "*.csv" in a -batchMask template to
+// match -format, so -format=ndjson produces *.ndjson files without the user
+// having to edit the mask by hand. The -csv path is not rewritten.
+func applyFormatExtension(mask string, format string) string {
+	if strings.EqualFold(format, "csv") || format == "" {
+		return mask
+	}
+	return strings.Replace(mask, "*.csv", "*"+formatExtension(format), 1)
+}
+
+// formatExtension returns the default file extension for -format, used to
+// rewrite a literal "*.csv" in -batchMask when the format isn't CSV.
+func formatExtension(format string) string {
+	switch strings.ToLower(format) {
+	case "tsv":
+		return ".tsv"
+	case "ndjson":
+		return ".ndjson"
+	case "json":
+		return ".json"
+	case "parquet":
+		return ".parquet"
+	default:
+		return ".csv"
+	}
+}
+
+// delimitedRowSink implements RowSink for CSV and TSV: the header is just
+// the first row, written like any other.
+type delimitedRowSink struct {
+	writer *csv.Writer
+}
+
+func newDelimitedRowSink(output io.Writer, comma rune) *delimitedRowSink {
+	csvWriter := csv.NewWriter(output)
+	csvWriter.Comma = comma
+	return &delimitedRowSink{writer: csvWriter}
+}
+
+func (s *delimitedRowSink) WriteHeader(header []string) error { return s.writer.Write(header) }
+func (s *delimitedRowSink) WriteRow(row []string) error       { return s.writer.Write(row) }
+func (s *delimitedRowSink) Close() error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+// columnHeader resolves the effective column names: the first scanned row,
+// or col1/col2/... if -noHeader (in which case that first row is data).
+func columnHeader(header []string, noHeader bool) []string {
+	if !noHeader {
+		return append([]string{}, header...)
+	}
+	names := make([]string, len(header))
+	for i := range names {
+		names[i] = fmt.Sprintf("col%d", i+1)
+	}
+	return names
+}
+
+func rowToObject(header []string, row []string) map[string]string {
+	obj := make(map[string]string, len(header))
+	for i, name := range header {
+		if i < len(row) {
+			obj[name] = row[i]
+		} else {
+			obj[name] = ""
+		}
+	}
+	return obj
+}
+
+// ndjsonRowSink writes one JSON object per line, {header[i]: row[i], ...}.
+type ndjsonRowSink struct {
+	output   io.Writer
+	noHeader bool
+	header   []string
+}
+
+func newNdjsonRowSink(output io.Writer, noHeader bool) *ndjsonRowSink {
+	return &ndjsonRowSink{output: output, noHeader: noHeader}
+}
+
+func (s *ndjsonRowSink) WriteHeader(header []string) error {
+	s.header = columnHeader(header, s.noHeader)
+	if s.noHeader {
+		return s.WriteRow(header)
+	}
+	return nil
+}
+
+func (s *ndjsonRowSink) WriteRow(row []string) error {
+	data, err := json.Marshal(rowToObject(s.header, row))
+	if err != nil {
+		return err
+	}
+	_, err = s.output.Write(append(data, '\n'))
+	return err
+}
+
+func (s *ndjsonRowSink) Close() error { return nil }
+
+// jsonArrayRowSink streams a single JSON array of the same per-row objects
+// as ndjsonRowSink, without buffering the whole document in memory.
+type jsonArrayRowSink struct {
+	output   io.Writer
+	noHeader bool
+	header   []string
+	wroteAny bool
+	openErr  error
+}
+
+func newJSONArrayRowSink(output io.Writer, noHeader bool) *jsonArrayRowSink {
+	_, err := output.Write([]byte("["))
+	return &jsonArrayRowSink{output: output, noHeader: noHeader, openErr: err}
+}
+
+func (s *jsonArrayRowSink) WriteHeader(header []string) error {
+	if s.openErr != nil {
+		return s.openErr
+	}
+	s.header = columnHeader(header, s.noHeader)
+	if s.noHeader {
+		return s.WriteRow(header)
+	}
+	return nil
+}
+
+func (s *jsonArrayRowSink) WriteRow(row []string) error {
+	data, err := json.Marshal(rowToObject(s.header, row))
+	if err != nil {
+		return err
+	}
+	if s.wroteAny {
+		if _, err := s.output.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	s.wroteAny = true
+	_, err = s.output.Write(data)
+	return err
+}
+
+func (s *jsonArrayRowSink) Close() error {
+	_, err := s.output.Write([]byte("]\n"))
+	return err
+}
+
+var parquetFieldNameDisallowed = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func parquetFieldName(name string) string {
+	name = parquetFieldNameDisallowed.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// parquetColumnType is the inferred Parquet storage type of one column.
+type parquetColumnType int
+
+const (
+	parquetUTF8 parquetColumnType = iota
+	parquetInt64
+	parquetDouble
+	parquetBoolean
+)
+
+func inferParquetColumnType(values []string) parquetColumnType {
+	sawValue, allInt, allFloat, allBool := false, true, true, true
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		sawValue = true
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			allInt = false
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			allFloat = false
+		}
+		if _, err := strconv.ParseBool(value); err != nil {
+			allBool = false
+		}
+	}
+	switch {
+	case !sawValue:
+		return parquetUTF8
+	case allInt:
+		return parquetInt64
+	case allFloat:
+		return parquetDouble
+	case allBool:
+		return parquetBoolean
+	default:
+		return parquetUTF8
+	}
+}
+
+// parquetRowSink buffers the first parquetSchemaSampleSize rows to infer a
+// schema, then opens the Parquet writer and replays the buffered rows before
+// streaming the rest. Parquet fixes its schema at writer-open time, so a
+// later row that no longer matches an inferred int64/double/bool column is
+// reported as an error rather than silently written as NULL.
+type parquetRowSink struct {
+	path       string
+	noHeader   bool
+	header     []string
+	buffered   [][]string
+	columnType []parquetColumnType
+	file       source.ParquetFile
+	writer     *writer.JSONWriter
+}
+
+func newParquetRowSink(path string, noHeader bool) (*parquetRowSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("-format=parquet requires an output file path, not stdout")
+	}
+	return &parquetRowSink{path: path, noHeader: noHeader}, nil
+}
+
+func (s *parquetRowSink) WriteHeader(header []string) error {
+	s.header = columnHeader(header, s.noHeader)
+	if s.noHeader {
+		return s.WriteRow(header)
+	}
+	return nil
+}
+
+func (s *parquetRowSink) WriteRow(row []string) error {
+	if s.writer == nil {
+		s.buffered = append(s.buffered, row)
+		if len(s.buffered) < parquetSchemaSampleSize {
+			return nil
+		}
+		return s.flushSchemaAndBuffered()
+	}
+	return s.writeTypedRow(row, true)
+}
+
+func (s *parquetRowSink) Close() error {
+	if s.writer == nil {
+		if err := s.flushSchemaAndBuffered(); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.WriteStop(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *parquetRowSink) flushSchemaAndBuffered() error {
+	s.columnType = make([]parquetColumnType, len(s.header))
+	for col := range s.header {
+		values := make([]string, len(s.buffered))
+		for r, row := range s.buffered {
+			if col < len(row) {
+				values[r] = row[col]
+			}
+		}
+		s.columnType[col] = inferParquetColumnType(values)
+	}
+
+	file, err := local.NewLocalFileWriter(s.path)
+	if err != nil {
+		return err
+	}
+	jsonWriter, err := writer.NewJSONWriter(s.buildSchema(), file, 4)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file = file
+	s.writer = jsonWriter
+
+	for _, row := range s.buffered {
+		if err := s.writeTypedRow(row, false); err != nil {
+			return err
+		}
+	}
+	s.buffered = nil
+	return nil
+}
+
+func (s *parquetRowSink) buildSchema() string {
+	fields := make([]string, len(s.header))
+	for i, name := range s.header {
+		fieldName := parquetFieldName(name)
+		switch s.columnType[i] {
+		case parquetInt64:
+			fields[i] = fmt.Sprintf(`{"Tag":"name=%s, type=INT64, repetitiontype=OPTIONAL"}`, fieldName)
+		case parquetDouble:
+			fields[i] = fmt.Sprintf(`{"Tag":"name=%s, type=DOUBLE, repetitiontype=OPTIONAL"}`, fieldName)
+		case parquetBoolean:
+			fields[i] = fmt.Sprintf(`{"Tag":"name=%s, type=BOOLEAN, repetitiontype=OPTIONAL"}`, fieldName)
+		default:
+			fields[i] = fmt.Sprintf(`{"Tag":"name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}`, fieldName)
+		}
+	}
+	return fmt.Sprintf(`{"Tag":"name=parquet_go_root, repetitiontype=REQUIRED","Fields":[%s]}`, strings.Join(fields, ","))
+}
+
+// writeTypedRow converts row to the schema inferred from the first
+// parquetSchemaSampleSize rows and writes it. When outsideSample is true, row
+// came after the sample window was already committed to a fixed Parquet
+// schema: a value that no longer fits its column's type can't be silently
+// written as NULL (that would be silent data loss), and the schema can't be
+// widened to UTF8 after the fact either (Parquet commits to a schema at
+// writer-open time), so it's reported as an error instead.
+func (s *parquetRowSink) writeTypedRow(row []string, outsideSample bool) error {
+	obj := make(map[string]interface{}, len(s.header))
+	for i, name := range s.header {
+		value := ""
+		if i < len(row) {
+			value = row[i]
+		}
+		fieldName := parquetFieldName(name)
+		if value == "" {
+			obj[fieldName] = nil
+			continue
+		}
+		switch s.columnType[i] {
+		case parquetInt64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				if outsideSample {
+					return fmt.Errorf("-format=parquet: column %q was inferred as INT64 from the first %d rows, but row value %q doesn't parse as an integer; rerun without -format=parquet or ensure the sampled rows are representative", name, parquetSchemaSampleSize, value)
+				}
+				obj[fieldName] = nil
+				continue
+			}
+			obj[fieldName] = n
+		case parquetDouble:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				if outsideSample {
+					return fmt.Errorf("-format=parquet: column %q was inferred as DOUBLE from the first %d rows, but row value %q doesn't parse as a number; rerun without -format=parquet or ensure the sampled rows are representative", name, parquetSchemaSampleSize, value)
+				}
+				obj[fieldName] = nil
+				continue
+			}
+			obj[fieldName] = f
+		case parquetBoolean:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				if outsideSample {
+					return fmt.Errorf("-format=parquet: column %q was inferred as BOOLEAN from the first %d rows, but row value %q doesn't parse as a boolean; rerun without -format=parquet or ensure the sampled rows are representative", name, parquetSchemaSampleSize, value)
+				}
+				obj[fieldName] = nil
+				continue
+			}
+			obj[fieldName] = b
+		default:
+			obj[fieldName] = value
+		}
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return s.writer.Write(string(data))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sheetIndexValue backs the -sheet flag so it keeps accepting a plain zero
+// based index while also accepting the literal "all" (equivalent to -allSheets).
+type sheetIndexValue struct {
+	index *int
+	all   *bool
+}
+
+func (v *sheetIndexValue) String() string {
+	if v.index == nil {
+		return "-1"
+	}
+	return strconv.Itoa(*v.index)
+}
+
+func (v *sheetIndexValue) Set(s string) error {
+	if strings.EqualFold(s, "all") {
+		*v.all = true
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid -sheet value %q (expected an index or \"all\")", s)
+	}
+	*v.index = n
+	return nil
+}
+
+// newSheetIndexFlag registers the -sheet flag and returns the int/bool
+// pointers it writes into.
+func newSheetIndexFlag(name string, usage string) (*int, *bool) {
+	index := -1
+	all := false
+	flag.Var(&sheetIndexValue{index: &index, all: &all}, name, usage)
+	return &index, &all
+}
+
+var sheetNameUnsafeChars = regexp.MustCompile(`[/\\:*?"<>|]`)
+var sheetNameWhitespace = regexp.MustCompile(`\s+`)
+
+// sanitizeSheetName strips filesystem-unsafe characters from a sheet name so
+// it can be used as (part of) an output file name.
+func sanitizeSheetName(name string) string {
+	name = sheetNameUnsafeChars.ReplaceAllString(name, "")
+	name = sheetNameWhitespace.ReplaceAllString(name, " ")
+	name = strings.TrimSpace(name)
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	if name == "" {
+		name = "sheet"
+	}
+	return name
+}
+
+func sanitizeSheetNames(names []string) []string {
+	result := make([]string, len(names))
+	for i, name := range names {
+		result[i] = sanitizeSheetName(name)
+	}
+	return result
+}
+
+// dedupeSheetNames appends "-2", "-3", ... to sheet names that collide after
+// sanitization, so every sheet still gets a distinct output file. Candidates
+// are checked against every name already assigned, not just occurrences of
+// their own pre-image, so a generated "-2" can't collide with a genuine
+// sheet already named that way.
+func dedupeSheetNames(names []string) []string {
+	used := make(map[string]bool, len(names))
+	result := make([]string, len(names))
+	for i, name := range names {
+		candidate := name
+		for suffix := 2; used[candidate]; suffix++ {
+			candidate = fmt.Sprintf("%s-%d", name, suffix)
+		}
+		used[candidate] = true
+		result[i] = candidate
+	}
+	return result
+}
+
+// applySheetTokens resolves the #sheet#/#name# tokens in a -csv/-batchMask
+// path against one sheet's index and sanitized name. If neither token is
+// present (the caller gave a plain, non-templated path), the sanitized name
+// is inserted before the extension so sheets don't overwrite each other.
+func applySheetTokens(path string, sheetIndex int, sheetName string) string {
+	hasToken := strings.Contains(path, "#sheet#") || strings.Contains(path, "#name#")
+	result := strings.ReplaceAll(path, "#sheet#", strconv.Itoa(sheetIndex))
+	result = strings.ReplaceAll(result, "#name#", sheetName)
+	if !hasToken {
+		ext := filepath.Ext(result)
+		base := strings.TrimSuffix(result, ext)
+		result = base + "-" + sheetName + ext
+	}
+	return result
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// runStats accumulates batch-run counters across the worker goroutines; the
+// counters are only ever modified through the atomic add* helpers below.
+type runStats struct {
+	traversed int64
+	matched   int64
+	cached    int64
+	converted int64
+	changed   int64
+	failed    int64
+	bytesIn   int64
+	bytesOut  int64
+	started   time.Time
+}
+
+func newRunStats() *runStats {
+	return &runStats{started: time.Now()}
+}
+
+func (s *runStats) addTraversed(n int64) { atomic.AddInt64(&s.traversed, n) }
+func (s *runStats) addMatched(n int64)   { atomic.AddInt64(&s.matched, n) }
+func (s *runStats) addCached(n int64)    { atomic.AddInt64(&s.cached, n) }
+func (s *runStats) addConverted(n int64) { atomic.AddInt64(&s.converted, n) }
+func (s *runStats) addChanged(n int64)   { atomic.AddInt64(&s.changed, n) }
+func (s *runStats) addFailed(n int64)    { atomic.AddInt64(&s.failed, n) }
+func (s *runStats) addBytesIn(n int64)   { atomic.AddInt64(&s.bytesIn, n) }
+func (s *runStats) addBytesOut(n int64)  { atomic.AddInt64(&s.bytesOut, n) }
+
+// anyChanged reports whether at least one source produced output that
+// actually differs from what was already on disk, regardless of whether it
+// was served from the cache. This is what -failOnChange should fail on,
+// since the cache is irrelevant on a fresh/ephemeral checkout.
+func (s *runStats) anyChanged() bool {
+	return atomic.LoadInt64(&s.changed) > 0
+}
+
+func (s *runStats) String() string {
+	elapsed := time.Since(s.started)
+	return fmt.Sprintf(
+		"Traversed: %d, Matched: %d, Cached: %d, Converted: %d, Changed: %d, Failed: %d, bytesIn: %d, bytesOut: %d, elapsed: %s",
+		atomic.LoadInt64(&s.traversed), atomic.LoadInt64(&s.matched), atomic.LoadInt64(&s.cached),
+		atomic.LoadInt64(&s.converted), atomic.LoadInt64(&s.changed), atomic.LoadInt64(&s.failed),
+		atomic.LoadInt64(&s.bytesIn), atomic.LoadInt64(&s.bytesOut), elapsed.Round(time.Millisecond),
+	)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// inodeKey identifies a file by device+inode, used to detect symlink cycles
+// when -followSymlinks is on.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+func statInodeKey(path string) (inodeKey, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return inodeKey{}, false
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inodeKey{}, false
+	}
+	return inodeKey{dev: uint64(sys.Dev), ino: sys.Ino}, true
+}
+
+// matchesAny reports whether relPath matches any of the comma-separated
+// doublestar globs in patterns. An empty patterns string matches nothing.
+func matchesAny(patterns string, relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := doublestar.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectBatchFiles walks *runParameters.BatchPath (recursively when
+// -recursive is set, one level deep otherwise) and returns every matching
+// .xlsx/.xls file, sorted descending by size so large files start first.
+func collectBatchFiles(runParameters *TRunParameters, stats *runStats) ([]fileSortInfo, error) {
+	root := *runParameters.BatchPath
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, &os.PathError{Op: "collectBatchFiles", Path: root, Err: os.ErrInvalid}
+	}
+
+	visited := map[inodeKey]bool{}
+	if key, ok := statInodeKey(root); ok {
+		visited[key] = true
+	}
+
+	files := make([]fileSortInfo, 0)
+	walkErr := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relPath, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+
+		isSymlink := d.Type()&os.ModeSymlink != 0
+		if isSymlink {
+			if !*runParameters.FollowSymlinks {
+				return nil
+			}
+			targetInfo, statErr := os.Stat(path)
+			if statErr != nil {
+				return nil // broken symlink, skip
+			}
+			key, ok := statInodeKey(path)
+			if ok {
+				if visited[key] {
+					return nil // already visited this target, avoid a cycle
+				}
+				visited[key] = true
+			}
+			if targetInfo.IsDir() {
+				if !*runParameters.Recursive {
+					return nil // subfolders are only entered with -recursive
+				}
+				resolved, resolveErr := filepath.EvalSymlinks(path)
+				if resolveErr != nil {
+					return nil // broken/unresolvable target, skip
+				}
+				return filepath.WalkDir(resolved, func(innerPath string, innerD fs.DirEntry, innerErr error) error {
+					if innerErr != nil || innerPath == resolved {
+						return innerErr
+					}
+					innerRel, relErr := filepath.Rel(resolved, innerPath)
+					if relErr != nil {
+						return relErr
+					}
+					return visitBatchEntry(runParameters, stats, &files, filepath.Join(path, innerRel), filepath.Join(relPath, innerRel), innerD)
+				})
+			}
+		}
+
+		if !*runParameters.Recursive && d.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return visitBatchEntry(runParameters, stats, &files, path, relPath, d)
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].size > files[j].size
+	})
+	return files, nil
+}
+
+func visitBatchEntry(runParameters *TRunParameters, stats *runStats, files *[]fileSortInfo, path string, relPath string, d fs.DirEntry) error {
+	if d.IsDir() {
+		return nil
+	}
+	stats.addTraversed(1)
+	if *runParameters.ExcludeGlobs != "" && matchesAny(*runParameters.ExcludeGlobs, relPath) {
+		return nil
+	}
+	if *runParameters.IncludeGlobs != "" {
+		if !matchesAny(*runParameters.IncludeGlobs, relPath) {
+			return nil
+		}
+	} else {
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".xlsx" && ext != ".xls" {
+			return nil
+		}
+	}
+	info, err := d.Info()
+	if err != nil {
+		return nil
+	}
+	stats.addMatched(1)
+	*files = append(*files, fileSortInfo{name: path, size: info.Size()})
+	return nil
+}